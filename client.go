@@ -1,26 +1,44 @@
 /*
-A client which first connects to aserver for authorization, then connect to fserver to grab fortune message.  
+A client which first connects to aserver for authorization, then connect to fserver to grab fortune message.
 
 Usage:
-$ go run client.go [local UDP ip:port] [aserver UDP ip:port] [secret]
+$ go run client.go [-transport tcp|udp] [local UDP ip:port] [aserver ip:port] [secret]
 
 Example:
 $ go run client.go 127.0.0.1:2020 127.0.0.1:7070 1984
+
+Flags:
+  -transport string   transport to use for both hops: tcp or udp (default "udp"); [local UDP ip:port] is ignored in tcp mode
 */
 
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/lookatsky/Client-Server-Practice-Golang/reliableudp"
+	"github.com/lookatsky/Client-Server-Practice-Golang/wire"
 )
 
+var transport = flag.String("transport", "udp", "transport to use for both hops: tcp or udp")
+
+// roundTripTimeout bounds how long the client waits for a reply to any
+// single hop (aserver Hello/Hash, then fserver) before giving up, over
+// either transport.
+const roundTripTimeout = 10 * time.Second
+
 /////////// Msgs used by both auth and fortune servers:
 
 // An error message from the server.
@@ -30,27 +48,59 @@ type ErrMessage struct {
 
 /////////// Auth server msgs:
 
-// Message containing a nonce from auth-server.
+// CurrentVersion is the protocol version spoken by this build of the
+// client and servers. Every Envelope carries the version of the sender,
+// so a future revision of the wire format can be rolled out while old
+// and new clients/servers are both still running.
+const CurrentVersion = 1
+
+// Envelope wraps every message exchanged between client and aserver so
+// the receiver can dispatch on Type before unmarshalling Payload, and
+// can reject (or, later, adapt to) a Version it does not speak.
+type Envelope struct {
+	Version int
+	Type    string
+	Payload json.RawMessage
+}
+
+// Message from client initiating a handshake with a fresh client nonce.
+type HelloMessage struct {
+	ClientNonce int64
+}
+
+// Message containing the server's nonce, sent in response to a HelloMessage.
 type NonceMessage struct {
-	Nonce int64
+	ServerNonce int64
 }
 
-// Message containing an MD5 hash from client to auth-server.
+// Message containing an HMAC-SHA256 MAC of the client and server nonces,
+// proving knowledge of the shared secret, from client to auth-server.
 type HashMessage struct {
-	Hash string
+	Mac string
 }
 
-// Message with details for contacting the fortune-server.
+// Message with details for contacting the fortune-server, signed by
+// aserver so the client can detect a tampered or forged reply. Token and
+// Expiry are minted by fserver and are opaque to the client; they are
+// relayed to fserver verbatim when the client requests its fortune.
 type FortuneInfoMessage struct {
 	FortuneServer string
 	FortuneNonce  int64
+	Token         string
+	Expiry        int64
+	Signature     string
 }
 
 /////////// Fortune server msgs:
 
-// Message requesting a fortune from the fortune-server.
+// Message requesting a fortune from the fortune-server. ClientID, Token
+// and Expiry are copied verbatim from the FortuneInfoMessage so fserver
+// can verify them without trusting the UDP source address.
 type FortuneReqMessage struct {
+	ClientID     string
 	FortuneNonce int64
+	Token        string
+	Expiry       int64
 }
 
 // Response from the fortune-server containing the fortune.
@@ -60,87 +110,238 @@ type FortuneMessage struct {
 
 // Main workhorse method.
 func main() {
+	flag.Parse()
+
 	// parse inputs
-	localAddr := os.Args[1]
-	serverAddr := os.Args[2]
-	secretStr := os.Args[3]
+	args := flag.Args()
+	if len(args) != 3 {
+		fmt.Println("usage: client [flags] [local UDP ip:port] [aserver ip:port] [secret]")
+		os.Exit(1)
+	}
+	localAddr := args[0]
+	serverAddr := args[1]
+	secretStr := args[2]
 	secret, err := strconv.ParseInt(secretStr, 10, 64)
 	printErr(err)
 	//	fmt.Printf("local: %s, server: %s, secret: %v\n", localAddr, serverAddr, secret)
-	msg := make([]byte, 1024)
 
-	// sends a UDP message with arbitrary payload to the aserver
-	aAddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	roundTrip, closeRoundTripper, err := newRoundTripper(*transport, localAddr)
 	printErr(err)
-	lAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	defer closeRoundTripper()
+
+	// sends a HelloMessage with a fresh client nonce to the aserver
+	clientNonce, err := randomInt64()
 	printErr(err)
-	aConn, err := net.DialUDP("udp", lAddr, aAddr)
+	helloData, err := encodeEnvelope("Hello", HelloMessage{ClientNonce: clientNonce})
 	printErr(err)
-
-	msg[2] = byte(2)
-	_, err = aConn.Write(msg)
+	helloCtx, cancelHello := context.WithTimeout(context.Background(), roundTripTimeout)
+	defer cancelHello()
+	reply, err := roundTrip(helloCtx, serverAddr, helloData)
 	printErr(err)
 
-	// receives a NonceMessage reply containing an int64 nonce from the aserver
-	n, err := aConn.Read(msg)
+	// receives a NonceMessage reply containing the server's nonce
+	env, err := decodeEnvelope(reply)
 	printErr(err)
-	//	fmt.Printf("%s\n", msg[0:n])
-
+	if env.Type == "Error" {
+		printServerError(env)
+	}
 	var nonce NonceMessage
-	err = json.Unmarshal(msg[0:n], &nonce)
+	err = json.Unmarshal(env.Payload, &nonce)
 	printErr(err)
 
-	// computes an MD5 hash of the (nonce + secret) value and sents this value as a hex string to the aserver as part of a HashMessage
-	value := nonce.Nonce + secret
-	n = binary.PutVarint(msg, value)
-	hash := md5.Sum(msg[:n])
-	hashStr := hex.EncodeToString(hash[:])
-	//	fmt.Printf("nonce(%v) + secret(%v) : %v; \nMD5 hash: %v\n", nonce.Nonce, secret, value, hashStr)
-
+	// computes an HMAC-SHA256 MAC of (clientNonce, serverNonce) keyed by the
+	// shared secret, and sends it to the aserver as part of a HashMessage
+	mac := computeMac(secret, clientNonce, nonce.ServerNonce)
 	var hashMsg HashMessage
-	hashMsg.Hash = hashStr
-	sendmsg, err := json.Marshal(hashMsg)
+	hashMsg.Mac = hex.EncodeToString(mac)
+	hashData, err := encodeEnvelope("Hash", hashMsg)
 	printErr(err)
-	_, err = aConn.Write(sendmsg)
+	hashCtx, cancelHash := context.WithTimeout(context.Background(), roundTripTimeout)
+	defer cancelHash()
+	reply, err = roundTrip(hashCtx, serverAddr, hashData)
 	printErr(err)
 
-	// the aserver verifies the received hash and replies with a FortuneInfoMessage
-	n, err = aConn.Read(msg)
+	// the aserver verifies the received MAC and replies with a signed FortuneInfoMessage
+	env, err = decodeEnvelope(reply)
 	printErr(err)
-	//	fmt.Printf("%s",msg[0:n])
+	if env.Type == "Error" {
+		printServerError(env)
+	}
 	var fortuneInfo FortuneInfoMessage
-	err = json.Unmarshal(msg[0:n], &fortuneInfo)
+	err = json.Unmarshal(env.Payload, &fortuneInfo)
 	printErr(err)
 
-	// the client sends a FortuneReqMessage to fserver
-	fAddr, err := net.ResolveUDPAddr("udp", fortuneInfo.FortuneServer)
-	printErr(err)
-	err = aConn.Close()
-	printErr(err)
-	fConn, err := net.DialUDP("udp", lAddr, fAddr)
-	printErr(err)
+	// verify the aserver's signature before trusting the fortune-server address
+	gotSig, err := hex.DecodeString(fortuneInfo.Signature)
+	expectedSig := signFortuneInfo(secret, nonce.ServerNonce, fortuneInfo)
+	if err != nil || !hmac.Equal(gotSig, expectedSig) {
+		fmt.Println("Error message: fortune server info failed signature verification")
+		os.Exit(1)
+	}
 
+	// the client sends a FortuneReqMessage to fserver
 	var fortuneReqMsg FortuneReqMessage
+	fortuneReqMsg.ClientID = clientIDFor(clientNonce)
 	fortuneReqMsg.FortuneNonce = fortuneInfo.FortuneNonce
+	fortuneReqMsg.Token = fortuneInfo.Token
+	fortuneReqMsg.Expiry = fortuneInfo.Expiry
 	reqMsg, err := json.Marshal(fortuneReqMsg)
 	printErr(err)
-	_, err = fConn.Write(reqMsg)
-	printErr(err)
 
 	// the client receives a fortunemessage from the fserver
-	n, err = fConn.Read(msg)
+	fortuneCtx, cancelFortune := context.WithTimeout(context.Background(), roundTripTimeout)
+	defer cancelFortune()
+	reply, err = roundTrip(fortuneCtx, fortuneInfo.FortuneServer, reqMsg)
 	printErr(err)
 	var fMsg FortuneMessage
-	err = json.Unmarshal(msg[0:n], &fMsg)
+	err = json.Unmarshal(reply, &fMsg)
 	printErr(err)
 
 	fmt.Println(fMsg.Fortune)
 
 }
 
+// newRoundTripper builds the function the client uses to send a message
+// to an address and wait for its reply, for the given transport. Both
+// the aserver and fserver hops go through the same roundTripper.
+func newRoundTripper(transport string, localAddr string) (roundTrip func(ctx context.Context, addr string, msg []byte) ([]byte, error), closeFn func(), err error) {
+	switch transport {
+	case "udp":
+		lAddr, err := net.ResolveUDPAddr("udp", localAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		// a single unconnected socket is used for both the aserver and
+		// fserver hops; the reliable UDP layer acks, retransmits and
+		// deduplicates on top of it
+		udpConn, err := net.ListenUDP("udp", lAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		rConn := reliableudp.New(udpConn)
+		go rConn.Serve(nil)
+
+		return func(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+			uAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return rConn.Send(ctx, uAddr, msg)
+		}, func() { rConn.Close() }, nil
+
+	case "tcp":
+		// aserver ties the Hello and Hash messages of one handshake
+		// together by the connection they arrive on, so the client keeps
+		// one connection open per peer address rather than dialing fresh
+		// for every message.
+		conns := make(map[string]net.Conn)
+		return func(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+				conn, ok := conns[addr]
+				if !ok {
+					var d net.Dialer
+					var err error
+					conn, err = d.DialContext(ctx, "tcp", addr)
+					if err != nil {
+						return nil, err
+					}
+					conns[addr] = conn
+				}
+				if deadline, ok := ctx.Deadline(); ok {
+					conn.SetDeadline(deadline)
+				}
+				if err := wire.Send(conn, msg); err != nil {
+					return nil, err
+				}
+				return wire.Recv(conn)
+			}, func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown -transport %q", transport)
+	}
+}
+
+// randomInt64 returns a cryptographically random int64, used for the
+// client nonce that must not be predictable by an attacker.
+func randomInt64() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
+
+// computeMac computes the HMAC-SHA256 proof of knowledge of secret over
+// the client and server nonces for this handshake.
+func computeMac(secret, clientNonce, serverNonce int64) []byte {
+	mac := hmac.New(sha256.New, int64Bytes(secret))
+	mac.Write(int64Bytes(clientNonce))
+	mac.Write(int64Bytes(serverNonce))
+	return mac.Sum(nil)
+}
+
+// signFortuneInfo computes the HMAC-SHA256 signature over the contents
+// of a FortuneInfoMessage so the client can verify it came from aserver.
+func signFortuneInfo(secret, serverNonce int64, fInfoMsg FortuneInfoMessage) []byte {
+	mac := hmac.New(sha256.New, int64Bytes(secret))
+	mac.Write(int64Bytes(serverNonce))
+	mac.Write(int64Bytes(fInfoMsg.FortuneNonce))
+	mac.Write([]byte(fInfoMsg.FortuneServer))
+	mac.Write([]byte(fInfoMsg.Token))
+	mac.Write(int64Bytes(fInfoMsg.Expiry))
+	return mac.Sum(nil)
+}
+
+// clientIDFor derives a stable client identifier from its client nonce,
+// independent of its network address.
+func clientIDFor(clientNonce int64) string {
+	return hex.EncodeToString(int64Bytes(clientNonce))
+}
+
+func int64Bytes(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// encodeEnvelope marshals v, wrapped in an Envelope of the given type and
+// the current protocol version.
+func encodeEnvelope(msgType string, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Version: CurrentVersion, Type: msgType, Payload: payload})
+}
+
+// decodeEnvelope unwraps an Envelope, rejecting a reply whose protocol
+// version this client does not speak.
+func decodeEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, err
+	}
+	if env.Version != CurrentVersion {
+		return Envelope{}, fmt.Errorf("unsupported protocol version %d", env.Version)
+	}
+	return env, nil
+}
+
+// printServerError prints the Error field of an "Error" envelope and exits.
+func printServerError(env Envelope) {
+	var errMsg ErrMessage
+	if err := json.Unmarshal(env.Payload, &errMsg); err == nil {
+		fmt.Println("Error message:", errMsg.Error)
+	}
+	os.Exit(1)
+}
+
 func printErr(e error) {
 	if e != nil {
 		fmt.Println("Error message:", e)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
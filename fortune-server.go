@@ -1,24 +1,55 @@
 /*
 Implemented a fortune server which receives client request via UDP, and replies with a fortune message if client is authorized.
-It checks client authorization by connecting to an authorization server (aserver) via RPC.
+It checks client authorization by verifying a token that it minted itself when the authorization server (aserver) requested one via RPC.
 
 Usage:
-$ go run fortune-server.go [fserver RPC ip:port] [fserver UDP ip:port] [fortune-string]
-[fserver RPC ip:port] : the TCP address on which the fserver listens to RPC connections from the aserver
-[fserver UDP ip:port] : the UDP address on which the fserver receives client connections
-[fortune-string] : a fortune string that may include spaces, but not other whitespace characters
+$ go run fortune-server.go [-backend static|file|http|redis] [backend flags] [-metrics-addr ip:port] [-transport tcp|udp] [RPC TLS flags] [fserver RPC ip:port] [fserver client ip:port]
+[fserver RPC ip:port]    : the TCP address on which the fserver listens to RPC connections from the aserver
+[fserver client ip:port] : the address on which the fserver receives client connections, over -transport
+
+Backend flags:
+  -backend string        fortune backend: static, file, http, or redis (default "static")
+  -fortune string        fortune string for the static backend
+  -fortune-file string   path to a %-delimited fortune-cookie file for the file backend
+  -http-url string       URL to fetch a fortune from for the http backend
+  -http-timeout duration timeout for http backend requests (default 2s)
+  -http-cache-ttl duration how long a fetched fortune is reused before the http backend is hit again (default 30s)
+  -redis-addr string     redis address for the redis backend
+  -redis-set string      redis set name for the redis backend (default "fortunes")
+  -metrics-addr string   address to serve /metrics and /healthz on (disabled if empty)
+  -transport string      transport for the client-facing socket: tcp or udp (default "udp")
+
+RPC TLS flags (all three required together to enable TLS on the aserver<->fserver RPC channel):
+  -rpc-tls-cert string   this server's certificate, PEM-encoded
+  -rpc-tls-key string    this server's private key, PEM-encoded
+  -rpc-tls-ca string     CA bundle used to verify the aserver's client certificate
 */
 
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"math/rand"
+	"io"
+	mathrand "math/rand"
 	"net"
 	"net/rpc"
 	"os"
-	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lookatsky/Client-Server-Practice-Golang/fortune"
+	"github.com/lookatsky/Client-Server-Practice-Golang/observability"
+	"github.com/lookatsky/Client-Server-Practice-Golang/reliableudp"
+	"github.com/lookatsky/Client-Server-Practice-Golang/wire"
 )
 
 /////////// Msgs used by both auth and fortune servers:
@@ -30,9 +61,15 @@ type ErrMessage struct {
 
 /////////// Fortune server msgs:
 
-// Message requesting a fortune from the fortune-server.
+// Message requesting a fortune from the fortune-server. ClientID, Token
+// and Expiry are copied verbatim from the FortuneInfoMessage the client
+// received from aserver, so fserver can verify them without trusting
+// the UDP source address.
 type FortuneReqMessage struct {
+	ClientID     string
 	FortuneNonce int64
+	Token        string
+	Expiry       int64
 }
 
 // Response from the fortune-server containing the fortune.
@@ -44,113 +81,298 @@ type FortuneMessage struct {
 type FortuneInfoMessage struct {
 	FortuneServer string
 	FortuneNonce  int64
+	Token         string
+	Expiry        int64
+}
+
+// fortuneTokenTTL bounds how long a token minted by GetFortuneInfo remains valid.
+const fortuneTokenTTL = 30 * time.Second
+
+// FortuneInfoRequest identifies the client a FortuneInfoMessage is being
+// minted for. ClientID is a value only the client and aserver know ahead
+// of time (not derived from its network address), so the resulting token
+// keeps working if the client's UDP source address changes afterwards.
+type FortuneInfoRequest struct {
+	ClientID string
 }
 
 type FortuneServerRPC struct {
-	m      map[string]int64
-	mux    sync.Mutex
-	server string
+	server   string
+	tokenKey []byte // secret key used to mint and verify fortune tokens; known only to this fserver
 }
 
-func (this *FortuneServerRPC) GetFortuneInfo(clientAddr string, fInfoMsg *FortuneInfoMessage) error {
-	rand.Seed(110)
-	newNonce := rand.Int63()
-	this.mux.Lock()
-	this.m[clientAddr] = newNonce
-	this.mux.Unlock()
+func (this *FortuneServerRPC) GetFortuneInfo(req FortuneInfoRequest, fInfoMsg *FortuneInfoMessage) error {
+	newNonce := mathrand.Int63()
+
+	expiry := time.Now().Add(fortuneTokenTTL).Unix()
+	token := computeFortuneToken(this.tokenKey, req.ClientID, newNonce, expiry)
 
 	fInfoMsg.FortuneNonce = newNonce
 	fInfoMsg.FortuneServer = this.server
+	fInfoMsg.Token = hex.EncodeToString(token)
+	fInfoMsg.Expiry = expiry
 
 	return nil
 }
 
+var (
+	backend       = flag.String("backend", "static", "fortune backend: static, file, http, or redis")
+	fortuneStr    = flag.String("fortune", "", "fortune string for the static backend")
+	fortuneFile   = flag.String("fortune-file", "", "path to a %-delimited fortune-cookie file for the file backend")
+	httpURL       = flag.String("http-url", "", "URL to fetch a fortune from for the http backend")
+	httpTimeout   = flag.Duration("http-timeout", 2*time.Second, "timeout for http backend requests")
+	httpCacheTTL  = flag.Duration("http-cache-ttl", 30*time.Second, "how long a fetched fortune is reused before the http backend is hit again")
+	redisAddr     = flag.String("redis-addr", "", "redis address for the redis backend")
+	redisSet      = flag.String("redis-set", "fortunes", "redis set name for the redis backend")
+	metricsAddr   = flag.String("metrics-addr", "", "address to serve /metrics and /healthz on (disabled if empty)")
+	transport     = flag.String("transport", "udp", "transport for the client-facing socket: tcp or udp")
+	rpcTLSCert    = flag.String("rpc-tls-cert", "", "this server's certificate for the RPC channel, PEM-encoded")
+	rpcTLSKey     = flag.String("rpc-tls-key", "", "this server's private key for the RPC channel, PEM-encoded")
+	rpcTLSCA      = flag.String("rpc-tls-ca", "", "CA bundle used to verify the aserver's client certificate")
+)
+
+// retransmitPollInterval is how often the UDP listener publishes its
+// reliableudp retransmit count to retransmitGauge.
+const retransmitPollInterval = 10 * time.Second
+
+// metrics groups the counters and histograms fserver instruments its
+// request handling with.
+type metrics struct {
+	requestsTotal     *observability.Counter
+	authFailuresTotal *observability.Counter
+	retransmitGauge   *observability.Gauge
+	requestDuration   *observability.Histogram
+}
+
+func newMetrics(registry *observability.Registry) *metrics {
+	return &metrics{
+		requestsTotal:     registry.Counter("requests_total", "Total requests handled, by server and message type."),
+		authFailuresTotal: registry.Counter("auth_failures_total", "Total requests rejected, by server and reason."),
+		retransmitGauge:   registry.Gauge("reliableudp_retransmits", "Cumulative reliableudp retransmissions performed, by server."),
+		requestDuration:   registry.Histogram("request_duration_seconds", "Request handling latency in seconds, by server and message type.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}),
+	}
+}
+
 // Main workhorse method.
 func main() {
-	// parse inputs
-	fserverRPC := os.Args[1]
-	fserverUDP := os.Args[2]
-	fortuneString := os.Args[3]
-	//	fmt.Printf("local: %s, server: %s, secret: %v\n", localAddr, serverAddr, secret)
+	flag.Parse()
 
-	// receive udp connection from client
+	// seed math/rand once at startup from crypto/rand, instead of
+	// reseeding it (to the same value) on every GetFortuneInfo call,
+	// which made fortune nonces deterministic and identical
+	seed, err := cryptoSeed()
+	printErr(err, "seeding math/rand")
+	mathrand.Seed(seed)
 
-	// resolve address
-	fAddr, err := net.ResolveUDPAddr("udp", fserverUDP)
-	printErr(err, "resolve UDP address")
+	provider, err := buildProvider()
+	printErr(err, "configuring fortune backend")
 
-	// set up server
-	fConn, err := net.ListenUDP("udp", fAddr)
-	printErr(err, " listen UDP connection")
-	defer fConn.Close()
+	// parse inputs
+	args := flag.Args()
+	if len(args) != 2 {
+		fmt.Println("usage: fortune-server [flags] [fserver RPC ip:port] [fserver client ip:port]")
+		os.Exit(-1)
+	}
+	fserverRPC := args[0]
+	fserverClient := args[1]
+
+	// generate the key used to mint and verify fortune tokens
+	tokenKey := make([]byte, 32)
+	_, err = rand.Read(tokenKey)
+	printErr(err, "generating token key")
 
-	// serve rpc connection over tcp
+	// serve rpc connections from aserver, optionally behind mutual TLS
 	fortuneServerRPC := new(FortuneServerRPC)
-	fortuneServerRPC.server = fserverUDP
-	fortuneServerRPC.m = make(map[string]int64)
+	fortuneServerRPC.server = fserverClient
+	fortuneServerRPC.tokenKey = tokenKey
 	rpc.Register(fortuneServerRPC)
-	l, err := net.Listen("tcp", fserverRPC)
-	printErr(err, "listen tcp connection")
+	l, err := listenRPC(fserverRPC)
+	printErr(err, "listen RPC connection")
 
 	go rpc.Accept(l)
 
-	// handle request from client to udp server
+	registry := observability.NewRegistry()
+	m := newMetrics(registry)
+	if *metricsAddr != "" {
+		go func() {
+			printErr(registry.ListenAndServe(*metricsAddr), "serving metrics")
+		}()
+	}
+
+	handler := func(msg []byte) []byte {
+		return handleFortuneReq(msg, fortuneServerRPC, provider, m)
+	}
+
+	switch *transport {
+	case "udp":
+		fAddr, err := net.ResolveUDPAddr("udp", fserverClient)
+		printErr(err, "resolve UDP address")
+		fConn, err := net.ListenUDP("udp", fAddr)
+		printErr(err, " listen UDP connection")
+
+		// handle request from clients over the reliable UDP layer, which
+		// takes care of acking, retransmission and duplicate suppression
+		rConn := reliableudp.New(fConn)
+		defer rConn.Close()
+
+		// periodically publish rConn's retransmit count so it shows up on
+		// /metrics instead of only being available in-process
+		go func() {
+			ticker := time.NewTicker(retransmitPollInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				m.retransmitGauge.Set(int64(atomic.LoadUint64(&rConn.RetransmitCount)), map[string]string{"server": "fserver"})
+			}
+		}()
+
+		err = rConn.Serve(func(cAddr *net.UDPAddr, msg []byte) []byte {
+			fmt.Printf("message: %s received from %s\n", msg, cAddr)
+			return handler(msg)
+		})
+		printErr(err, "serving UDP connection")
+
+	case "tcp":
+		l, err := net.Listen("tcp", fserverClient)
+		printErr(err, "listen TCP connection")
+		printErr(serveTCP(l, handler), "serving TCP connection")
+
+	default:
+		printErr(fmt.Errorf("unknown -transport %q", *transport), "configuring transport")
+	}
+}
+
+// listenRPC listens for aserver's RPC connections, over mutual TLS if
+// -rpc-tls-cert/-rpc-tls-key/-rpc-tls-ca are all set, or plain TCP otherwise.
+func listenRPC(addr string) (net.Listener, error) {
+	if *rpcTLSCert == "" && *rpcTLSKey == "" && *rpcTLSCA == "" {
+		return net.Listen("tcp", addr)
+	}
+	tlsConfig, err := wire.LoadMutualTLSConfig(*rpcTLSCert, *rpcTLSKey, *rpcTLSCA)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, tlsConfig)
+}
+
+// serveTCP accepts client connections on l and, for each, reads
+// length-prefixed messages and replies to each via handler until the
+// client closes the connection.
+func serveTCP(l net.Listener, handler func(msg []byte) []byte) error {
 	for {
-		// read fortune message from clients
-		msg := make([]byte, 1024)
-		n, cAddr, err := fConn.ReadFromUDP(msg)
-		if err == nil {
-			fmt.Printf("message: %s received from %s\n", msg[0:n], cAddr)
-			//concurrently handle requests
-			go fortune(fConn, msg[0:n], fortuneServerRPC, fortuneString, cAddr)
+		conn, err := l.Accept()
+		if err != nil {
+			return err
 		}
+		go func() {
+			defer conn.Close()
+			for {
+				msg, err := wire.Recv(conn)
+				if err != nil {
+					if err != io.EOF {
+						fmt.Println("Error on reading TCP request: ", err)
+					}
+					return
+				}
+				fmt.Printf("message: %s received from %s\n", msg, conn.RemoteAddr())
+				if err := wire.Send(conn, handler(msg)); err != nil {
+					fmt.Println("Error on writing TCP reply: ", err)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// buildProvider constructs the fortune.Provider selected by -backend.
+func buildProvider() (fortune.Provider, error) {
+	switch *backend {
+	case "static":
+		return fortune.StaticProvider{Fortune: *fortuneStr}, nil
+	case "file":
+		return fortune.NewFileProvider(*fortuneFile)
+	case "http":
+		return fortune.NewHTTPProvider(*httpURL, *httpTimeout, *httpCacheTTL), nil
+	case "redis":
+		return fortune.NewRedisProvider(*redisAddr, *redisSet), nil
+	default:
+		return nil, fmt.Errorf("unknown -backend %q", *backend)
 	}
-	return
 }
 
 // process individual client request
-func fortune(conn *net.UDPConn, msg []byte, fortuneServerRPC *FortuneServerRPC, fortuneString string, cAddr *net.UDPAddr) {
+func handleFortuneReq(msg []byte, fortuneServerRPC *FortuneServerRPC, provider fortune.Provider, m *metrics) []byte {
+	start := time.Now()
+	defer func() {
+		m.requestsTotal.Inc(map[string]string{"server": "fserver", "type": "fortune"})
+		m.requestDuration.Observe(time.Since(start).Seconds(), map[string]string{"server": "fserver", "type": "fortune"})
+	}()
+
 	var fortuneReq FortuneReqMessage
 	err := json.Unmarshal(msg[:], &fortuneReq)
 
 	if err != nil {
 		// client sent malformed message, reply error
-		var malformedMsgError ErrMessage
-		malformedMsgError.Error = "could not interpret message"
-		malformmsg, _ := json.Marshal(malformedMsgError)
-		conn.WriteToUDP(malformmsg, cAddr)
-		return
-	} else {
-		// message valid, check for validity of nonce
-		fortuneServerRPC.mux.Lock()
-		validNonce, ok := fortuneServerRPC.m[cAddr.String()]
-		fortuneServerRPC.mux.Unlock()
-
-		if !ok {
-			// client sends a fortune nonce from a different address than it used in communicating with the aserver.
-			var unknownClientError ErrMessage
-			unknownClientError.Error = "unknown remote client address"
-			unknowmmsg, _ := json.Marshal(unknownClientError)
-			conn.WriteToUDP(unknowmmsg, cAddr)
-			return
-		} else {
-			if fortuneReq.FortuneNonce != validNonce {
-				// client sends incorrect nonce
-				var invalidNonceError ErrMessage
-				invalidNonceError.Error = "incorrect fortune nonce"
-				invalidNoncemsg, _ := json.Marshal(invalidNonceError)
-				conn.WriteToUDP(invalidNoncemsg, cAddr)
-				return
-			} else {
-				// client sends correct nonce, reply with fortune message
-				var fortuneMsg FortuneMessage
-				fortuneMsg.Fortune = fortuneString
-				replymsg, _ := json.Marshal(fortuneMsg)
-				conn.WriteToUDP(replymsg, cAddr)
-				return
-			}
-		}
+		m.authFailuresTotal.Inc(map[string]string{"server": "fserver", "reason": "malformed_request"})
+		return encodeError("could not interpret message")
+	}
+
+	// the token is only valid until Expiry; check that before anything else
+	if time.Now().Unix() > fortuneReq.Expiry {
+		m.authFailuresTotal.Inc(map[string]string{"server": "fserver", "reason": "token_expired"})
+		return encodeError("fortune token expired")
 	}
+
+	// verify the token against ClientID, FortuneNonce and Expiry; the
+	// client's source address plays no part in authorization, only in
+	// addressing the reply, so this works across NAT rebinding.
+	gotToken, err := hex.DecodeString(fortuneReq.Token)
+	expectedToken := computeFortuneToken(fortuneServerRPC.tokenKey, fortuneReq.ClientID, fortuneReq.FortuneNonce, fortuneReq.Expiry)
+	if err != nil || !hmac.Equal(gotToken, expectedToken) {
+		m.authFailuresTotal.Inc(map[string]string{"server": "fserver", "reason": "invalid_token"})
+		return encodeError("invalid fortune token")
+	}
+
+	// token valid, fetch and reply with a fortune from the configured backend
+	text, err := provider.Get(context.Background(), fortuneReq.ClientID)
+	if err != nil {
+		m.authFailuresTotal.Inc(map[string]string{"server": "fserver", "reason": "backend_error"})
+		return encodeError(fmt.Sprintf("fortune backend error: %v", err))
+	}
+
+	var fortuneMsg FortuneMessage
+	fortuneMsg.Fortune = text
+	replymsg, _ := json.Marshal(fortuneMsg)
+	return replymsg
+}
+
+// computeFortuneToken computes the HMAC-SHA256 token that authorizes a
+// client to redeem fortuneNonce before expiry.
+func computeFortuneToken(tokenKey []byte, clientID string, fortuneNonce int64, expiry int64) []byte {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(clientID))
+	mac.Write(int64Bytes(fortuneNonce))
+	mac.Write(int64Bytes(expiry))
+	return mac.Sum(nil)
+}
+
+func int64Bytes(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// cryptoSeed returns a seed for math/rand drawn from crypto/rand.
+func cryptoSeed() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
+
+func encodeError(reason string) []byte {
+	errmsg, _ := json.Marshal(ErrMessage{Error: reason})
+	return errmsg
 }
 
 func printErr(e error, s string) {
@@ -0,0 +1,76 @@
+package fortune
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"strings"
+)
+
+// FileProvider serves fortunes parsed from a classic fortune-cookie
+// file: records separated by a line containing only "%".
+type FileProvider struct {
+	records []string
+}
+
+// NewFileProvider reads and parses the fortune-cookie file at path.
+func NewFileProvider(path string) (*FileProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []string
+	var current strings.Builder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "%" {
+			if current.Len() > 0 {
+				records = append(records, strings.TrimSpace(current.String()))
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		records = append(records, strings.TrimSpace(current.String()))
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("fortune: %s contains no records", path)
+	}
+
+	return &FileProvider{records: records}, nil
+}
+
+// Get returns a record chosen at random. The selection is made with a
+// math/rand source re-seeded from crypto/rand on every call, so picks
+// aren't predictable or repeated across requests the way they'd be with
+// a single process-wide seed.
+func (p *FileProvider) Get(ctx context.Context, clientID string) (string, error) {
+	seed, err := cryptoSeed()
+	if err != nil {
+		return "", err
+	}
+	r := mathrand.New(mathrand.NewSource(seed))
+	return p.records[r.Intn(len(p.records))], nil
+}
+
+// cryptoSeed returns a seed for math/rand drawn from crypto/rand.
+func cryptoSeed() (int64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b[:])), nil
+}
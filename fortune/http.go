@@ -0,0 +1,86 @@
+package fortune
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPProvider fetches a fortune from a configured URL, with a timeout
+// and a single cached value good for cacheTTL. clientID has no bearing
+// on the cache: each client presents a fresh, one-shot nonce-derived ID
+// (see clientIDFor), so there is never a "repeat request from the same
+// client" to key on, and the URL is fixed per HTTPProvider instance (one
+// -http-url per fserver process) so an LRU keyed by URL would only ever
+// hold one entry anyway. A TTL lets the backend's fortune change over
+// time instead of freezing at whatever the first request fetched.
+type HTTPProvider struct {
+	URL      string
+	Client   *http.Client
+	CacheTTL time.Duration
+
+	mux        sync.Mutex
+	cached     string
+	cachedAt   time.Time
+	haveCached bool
+}
+
+// NewHTTPProvider builds an HTTPProvider that fetches from url, bounding
+// each request to timeout and caching the result for cacheTTL before
+// fetching again.
+func NewHTTPProvider(url string, timeout, cacheTTL time.Duration) *HTTPProvider {
+	return &HTTPProvider{
+		URL:      url,
+		Client:   &http.Client{Timeout: timeout},
+		CacheTTL: cacheTTL,
+	}
+}
+
+// Get implements Provider. clientID is accepted to satisfy Provider but
+// otherwise unused: see the HTTPProvider doc comment.
+func (p *HTTPProvider) Get(ctx context.Context, clientID string) (string, error) {
+	if fortune, ok := p.cachedFortune(); ok {
+		return fortune, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fortune: http backend returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	fortune := strings.TrimSpace(string(body))
+	p.mux.Lock()
+	p.cached = fortune
+	p.cachedAt = time.Now()
+	p.haveCached = true
+	p.mux.Unlock()
+	return fortune, nil
+}
+
+// cachedFortune returns the cached fortune if one was fetched within the
+// last CacheTTL.
+func (p *HTTPProvider) cachedFortune() (string, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.haveCached || time.Since(p.cachedAt) > p.CacheTTL {
+		return "", false
+	}
+	return p.cached, true
+}
@@ -0,0 +1,24 @@
+// Package fortune provides pluggable sources of fortune strings for
+// fserver, selected at startup via its -backend flag.
+package fortune
+
+import "context"
+
+// Provider supplies a fortune string for a given client. Implementations
+// may be stateless (StaticProvider), read from local storage
+// (FileProvider), or reach out to a remote service (HTTPProvider,
+// RedisProvider).
+type Provider interface {
+	Get(ctx context.Context, clientID string) (string, error)
+}
+
+// StaticProvider always returns the same fortune, configured up front.
+// This is fserver's original, pre-pluggable-backend behavior.
+type StaticProvider struct {
+	Fortune string
+}
+
+// Get implements Provider.
+func (p StaticProvider) Get(ctx context.Context, clientID string) (string, error) {
+	return p.Fortune, nil
+}
@@ -0,0 +1,87 @@
+package fortune
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RedisProvider selects a random fortune from a Redis set via
+// SRANDMEMBER. It speaks just enough of the RESP protocol to issue that
+// one command rather than pulling in a full client library.
+type RedisProvider struct {
+	Addr string
+	Set  string
+}
+
+// NewRedisProvider builds a RedisProvider that picks a random member of
+// set on the Redis instance at addr.
+func NewRedisProvider(addr, set string) *RedisProvider {
+	return &RedisProvider{Addr: addr, Set: set}
+}
+
+// Get implements Provider.
+func (p *RedisProvider) Get(ctx context.Context, clientID string) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(encodeRESPCommand("SRANDMEMBER", p.Set)); err != nil {
+		return "", err
+	}
+	return readRESPBulkString(bufio.NewReader(conn))
+}
+
+// encodeRESPCommand encodes args as a RESP array of bulk strings, the
+// format redis-server expects for a client command.
+func encodeRESPCommand(args ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return []byte(b.String())
+}
+
+// readRESPBulkString reads a single RESP reply, expecting a bulk string
+// (the SRANDMEMBER reply) or an error.
+func readRESPBulkString(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return "", fmt.Errorf("fortune: empty redis reply")
+	}
+
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "", fmt.Errorf("fortune: redis set is empty")
+		}
+		buf := make([]byte, n+2) // value followed by its trailing CRLF
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	case '-':
+		return "", fmt.Errorf("fortune: redis error: %s", line[1:])
+	default:
+		return "", fmt.Errorf("fortune: unexpected redis reply %q", line)
+	}
+}
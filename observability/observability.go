@@ -0,0 +1,273 @@
+// Package observability gives aserver and fserver a Prometheus-compatible
+// /metrics endpoint and a /healthz liveness endpoint, plus the
+// counters, histograms and gauges they instrument their request
+// handling with. It intentionally speaks only the Prometheus text
+// exposition format with the stdlib, rather than depending on the full
+// client_golang library.
+package observability
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry collects the counters, gauges and histograms instrumented by
+// a server and renders them in Prometheus text exposition format.
+type Registry struct {
+	mux        sync.Mutex
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	histograms map[string]*Histogram
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]*Gauge),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Counter registers (or returns the already-registered) monotonic
+// counter named name.
+func (r *Registry) Counter(name, help string) *Counter {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if c, ok := r.counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name, help: help, values: make(map[string]*int64Box)}
+	r.counters[name] = c
+	return c
+}
+
+// Gauge registers (or returns the already-registered) gauge named name.
+func (r *Registry) Gauge(name, help string) *Gauge {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if g, ok := r.gauges[name]; ok {
+		return g
+	}
+	g := &Gauge{name: name, help: help, values: make(map[string]*int64Box)}
+	r.gauges[name] = g
+	return g
+}
+
+// Histogram registers (or returns the already-registered) histogram
+// named name with the given bucket upper bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if h, ok := r.histograms[name]; ok {
+		return h
+	}
+	h := &Histogram{name: name, help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.histograms[name] = h
+	return h
+}
+
+// Render returns every registered metric in Prometheus text exposition format.
+func (r *Registry) Render() string {
+	r.mux.Lock()
+	counters := make([]*Counter, 0, len(r.counters))
+	for _, c := range r.counters {
+		counters = append(counters, c)
+	}
+	gauges := make([]*Gauge, 0, len(r.gauges))
+	for _, g := range r.gauges {
+		gauges = append(gauges, g)
+	}
+	histograms := make([]*Histogram, 0, len(r.histograms))
+	for _, h := range r.histograms {
+		histograms = append(histograms, h)
+	}
+	r.mux.Unlock()
+
+	var b strings.Builder
+	for _, c := range counters {
+		c.render(&b)
+	}
+	for _, g := range gauges {
+		g.render(&b)
+	}
+	for _, h := range histograms {
+		h.render(&b)
+	}
+	return b.String()
+}
+
+// ListenAndServe serves Registry's metrics on addr at /metrics, and a
+// liveness check at /healthz, until the process exits.
+func (r *Registry) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, r.Render())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// int64Box lets multiple goroutines atomically update one label series'
+// value without holding the parent metric's lock.
+type int64Box struct{ v int64 }
+
+// labelKey renders labels as a sorted, comma-joined key=\"value\" string,
+// both to use as a map key and as the text exposition format's label list.
+func labelKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func braces(labelStr string) string {
+	if labelStr == "" {
+		return ""
+	}
+	return "{" + labelStr + "}"
+}
+
+// Counter is a monotonically increasing value, optionally split by labels.
+type Counter struct {
+	name, help string
+	mux        sync.Mutex
+	values     map[string]*int64Box
+}
+
+// Inc increments the series identified by labels by one.
+func (c *Counter) Inc(labels map[string]string) {
+	c.Add(1, labels)
+}
+
+// Add increments the series identified by labels by delta.
+func (c *Counter) Add(delta int64, labels map[string]string) {
+	key := labelKey(labels)
+	c.mux.Lock()
+	box, ok := c.values[key]
+	if !ok {
+		box = &int64Box{}
+		c.values[key] = box
+	}
+	c.mux.Unlock()
+	atomic.AddInt64(&box.v, delta)
+}
+
+func (c *Counter) render(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for key, box := range c.values {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, braces(key), atomic.LoadInt64(&box.v))
+	}
+}
+
+// Gauge is a value that can go up or down, optionally split by labels.
+type Gauge struct {
+	name, help string
+	mux        sync.Mutex
+	values     map[string]*int64Box
+}
+
+// Set stores value for the series identified by labels.
+func (g *Gauge) Set(value int64, labels map[string]string) {
+	key := labelKey(labels)
+	g.mux.Lock()
+	box, ok := g.values[key]
+	if !ok {
+		box = &int64Box{}
+		g.values[key] = box
+	}
+	g.mux.Unlock()
+	atomic.StoreInt64(&box.v, value)
+}
+
+func (g *Gauge) render(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for key, box := range g.values {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, braces(key), atomic.LoadInt64(&box.v))
+	}
+}
+
+// histogramSeries is the bucket counts, sum and total count for one
+// label combination of a Histogram.
+type histogramSeries struct {
+	mux     sync.Mutex
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// Histogram tracks the distribution of observed values (typically
+// request latencies, in seconds) against a fixed set of bucket
+// boundaries, optionally split by labels.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+	mux        sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+// Observe records value against h's buckets for the series identified by labels.
+func (h *Histogram) Observe(value float64, labels map[string]string) {
+	key := labelKey(labels)
+	h.mux.Lock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{buckets: make([]int64, len(h.buckets))}
+		h.series[key] = s
+	}
+	h.mux.Unlock()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, boundary := range h.buckets {
+		if value <= boundary {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) render(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for key, s := range h.series {
+		s.mux.Lock()
+		for i, boundary := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(withLabel(key, "le", fmt.Sprintf("%g", boundary))), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(withLabel(key, "le", "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, braces(key), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(key), s.count)
+		s.mux.Unlock()
+	}
+}
+
+func withLabel(existing, key, value string) string {
+	pair := fmt.Sprintf("%s=%q", key, value)
+	if existing == "" {
+		return pair
+	}
+	return existing + "," + pair
+}
@@ -0,0 +1,396 @@
+// Package reliableudp provides a best-effort reliable request/response
+// layer over UDP for this project's client/aserver/fserver hops, which
+// otherwise do a single Write+Read per hop and silently hang or fail on
+// packet loss.
+//
+// Every message is tagged with a session ID and a sequence number, ACKed
+// by the receiver, and retransmitted by the sender with exponential
+// backoff until answered or a retry budget is exhausted. Each peer's
+// handled sequence numbers are tracked in a connection-tracking table
+// (Conn.tracks) keyed by (peer address, session ID) - the same shape used by UDP proxies such
+// as Docker's UDPProxy to track ephemeral flows - so a duplicate
+// retransmission is recognized and answered from cache instead of being
+// handled twice; idle entries are evicted by a background janitor.
+package reliableudp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// InitialBackoff is the delay before the first retransmission of an unacked send.
+	InitialBackoff = 200 * time.Millisecond
+	// DefaultMaxBackoff caps the exponential backoff between retransmissions.
+	DefaultMaxBackoff = 800 * time.Millisecond
+	// DefaultMaxRetries bounds how many times an unanswered send is retransmitted before giving up.
+	DefaultMaxRetries = 4
+	// DefaultIdleTimeout is how long a peer's tracked session may sit unused before the janitor evicts it.
+	DefaultIdleTimeout = 30 * time.Second
+
+	flagData byte = 0
+	flagAck  byte = 1
+
+	// headerLen is 8 bytes session ID + 4 bytes sequence number + 1 byte flag.
+	headerLen = 13
+)
+
+// ErrTimedOut is returned by Send when a payload got no reply after
+// MaxRetries retransmissions, whether or not it was ACKed.
+var ErrTimedOut = errors.New("reliableudp: timed out waiting for reply")
+
+// Handler processes a request payload received from peer and returns the
+// response payload to send back, or nil to send no response.
+type Handler func(peer *net.UDPAddr, payload []byte) []byte
+
+// Conn wraps a *net.UDPConn with the reliable request/response layer.
+// The wrapped conn must be unconnected (created with net.ListenUDP), so
+// both Send and Serve can address arbitrary peers.
+type Conn struct {
+	udp *net.UDPConn
+
+	MaxRetries  int
+	MaxBackoff  time.Duration
+	IdleTimeout time.Duration
+
+	handler Handler
+
+	nextSession uint64
+
+	pendingMux sync.Mutex
+	pending    map[uint64]*pendingSend
+
+	trackMux sync.Mutex
+	tracks   map[connTrackKey]*connTrack
+
+	// RetransmitCount counts every retransmission performed by Send, for use as a metric.
+	RetransmitCount uint64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// pendingSend is the bookkeeping for one in-flight Send call.
+type pendingSend struct {
+	addr    *net.UDPAddr
+	ackCh   chan struct{}
+	replyCh chan []byte
+}
+
+// connTrackKey identifies one peer's session, mirroring the (peerAddr,
+// sessionID) keying used by UDP connection-tracking proxies.
+type connTrackKey struct {
+	peer      string
+	sessionID uint64
+}
+
+// connTrack is the per-session state kept on the receiving side: the
+// set of sequence numbers already handled for this peer and session
+// (every one is kept until the janitor evicts the session; there is no
+// sliding window), the cached reply for each (so a duplicate request can be
+// answered without re-running the handler), and the last time either was touched.
+type connTrack struct {
+	mux        sync.Mutex
+	seenSeqs   map[uint32]struct{}
+	replies    map[uint32][]byte
+	lastActive time.Time
+}
+
+// New wraps udp (which must be unconnected) with the reliable layer and
+// starts its idle-session janitor.
+func New(udp *net.UDPConn) *Conn {
+	c := &Conn{
+		udp:         udp,
+		MaxRetries:  DefaultMaxRetries,
+		MaxBackoff:  DefaultMaxBackoff,
+		IdleTimeout: DefaultIdleTimeout,
+		pending:     make(map[uint64]*pendingSend),
+		tracks:      make(map[connTrackKey]*connTrack),
+		closed:      make(chan struct{}),
+	}
+	go c.janitor()
+	return c
+}
+
+// Close stops the janitor and closes the underlying UDP socket.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.udp.Close()
+}
+
+// Send transmits payload to addr and blocks until it is answered,
+// retransmitting with exponential backoff while unacknowledged. An ACK
+// from addr only confirms the request arrived - it says nothing about
+// whether the eventual reply will - so Send keeps retransmitting the
+// original payload (at MaxBackoff pace) even after the ACK, bounded by
+// the same MaxRetries budget, until either a reply or ctx arrives. The
+// peer's connTrack window recognizes these as duplicates of an
+// already-handled request and answers from its cached reply instead of
+// re-running the handler, so a lost reply datagram no longer hangs the
+// caller forever.
+func (c *Conn) Send(ctx context.Context, addr *net.UDPAddr, payload []byte) ([]byte, error) {
+	sessionID := atomic.AddUint64(&c.nextSession, 1)
+
+	send := &pendingSend{addr: addr, ackCh: make(chan struct{}, 1), replyCh: make(chan []byte, 1)}
+	c.pendingMux.Lock()
+	c.pending[sessionID] = send
+	c.pendingMux.Unlock()
+	defer func() {
+		c.pendingMux.Lock()
+		delete(c.pending, sessionID)
+		c.pendingMux.Unlock()
+	}()
+
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	if err := c.sendData(addr, sessionID, 0, payload); err != nil {
+		return nil, err
+	}
+
+	backoff := InitialBackoff
+	acked := false
+	retries := 0
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case reply := <-send.replyCh:
+			timer.Stop()
+			return reply, nil
+		case <-send.ackCh:
+			timer.Stop()
+			acked = true
+		case <-timer.C:
+			if retries >= maxRetries {
+				return nil, ErrTimedOut
+			}
+			retries++
+			atomic.AddUint64(&c.RetransmitCount, 1)
+			if err := c.sendData(addr, sessionID, 0, payload); err != nil {
+				return nil, err
+			}
+			if acked {
+				// The request is confirmed delivered; keep re-asking for
+				// the reply at a steady pace instead of growing backoff
+				// further, since the peer will answer a duplicate from
+				// its cached reply rather than redo any work.
+				backoff = maxBackoff
+			} else {
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+			}
+		}
+	}
+}
+
+// Serve reads packets until the Conn is closed, dispatching ACKs and
+// replies to the Send calls waiting on them and, for anything else,
+// invoking handler with the request payload and sending its return value
+// back as the response. handler may be nil for a Conn only used to Send.
+func (c *Conn) Serve(handler Handler) error {
+	c.handler = handler
+	buf := make([]byte, 65535)
+	for {
+		select {
+		case <-c.closed:
+			return net.ErrClosed
+		default:
+		}
+
+		c.udp.SetReadDeadline(time.Now().Add(time.Second))
+		n, peer, err := c.udp.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		pkt, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		go c.handlePacket(peer, pkt)
+	}
+}
+
+func (c *Conn) handlePacket(peer *net.UDPAddr, pkt packet) {
+	c.pendingMux.Lock()
+	send, isReply := c.pending[pkt.sessionID]
+	c.pendingMux.Unlock()
+	if isReply && !addrEqual(send.addr, peer) {
+		// Someone other than the peer we actually sent to is trying to
+		// answer this session - the socket is unconnected so the kernel
+		// won't filter this for us. Treat it as an unrelated inbound
+		// packet rather than honoring it as our ack/reply.
+		isReply = false
+	}
+
+	switch pkt.flag {
+	case flagAck:
+		if isReply {
+			select {
+			case send.ackCh <- struct{}{}:
+			default:
+			}
+		}
+		return
+
+	case flagData:
+		if isReply {
+			// this is the response to one of our own Send calls
+			c.sendAck(peer, pkt.sessionID, pkt.seq)
+			select {
+			case send.replyCh <- pkt.payload:
+			default:
+			}
+			return
+		}
+
+		// otherwise this is an inbound request for our handler
+		track := c.trackFor(connTrackKey{peer: peer.String(), sessionID: pkt.sessionID})
+
+		track.mux.Lock()
+		if _, dup := track.seenSeqs[pkt.seq]; dup {
+			reply := track.replies[pkt.seq]
+			track.lastActive = time.Now()
+			track.mux.Unlock()
+			c.sendAck(peer, pkt.sessionID, pkt.seq)
+			if reply != nil {
+				c.sendData(peer, pkt.sessionID, pkt.seq+1, reply)
+			}
+			return
+		}
+		track.seenSeqs[pkt.seq] = struct{}{}
+		track.lastActive = time.Now()
+		track.mux.Unlock()
+
+		c.sendAck(peer, pkt.sessionID, pkt.seq)
+
+		if c.handler == nil {
+			return
+		}
+		reply := c.handler(peer, pkt.payload)
+		if reply == nil {
+			return
+		}
+
+		track.mux.Lock()
+		track.replies[pkt.seq] = reply
+		track.lastActive = time.Now()
+		track.mux.Unlock()
+
+		c.sendData(peer, pkt.sessionID, pkt.seq+1, reply)
+	}
+}
+
+// addrEqual reports whether a and b refer to the same UDP endpoint,
+// using net.IP.Equal so equivalent IPv4 and IPv4-in-IPv6 forms match.
+func addrEqual(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+func (c *Conn) trackFor(key connTrackKey) *connTrack {
+	c.trackMux.Lock()
+	defer c.trackMux.Unlock()
+	t, ok := c.tracks[key]
+	if !ok {
+		t = &connTrack{
+			seenSeqs:   make(map[uint32]struct{}),
+			replies:    make(map[uint32][]byte),
+			lastActive: time.Now(),
+		}
+		c.tracks[key] = t
+	}
+	return t
+}
+
+// janitor evicts connTrack entries that have been idle longer than IdleTimeout.
+func (c *Conn) janitor() {
+	interval := c.IdleTimeout
+	if interval == 0 {
+		interval = DefaultIdleTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-interval)
+			c.trackMux.Lock()
+			for key, t := range c.tracks {
+				t.mux.Lock()
+				stale := t.lastActive.Before(cutoff)
+				t.mux.Unlock()
+				if stale {
+					delete(c.tracks, key)
+				}
+			}
+			c.trackMux.Unlock()
+		}
+	}
+}
+
+func (c *Conn) sendData(addr *net.UDPAddr, sessionID uint64, seq uint32, payload []byte) error {
+	return c.write(addr, packet{sessionID: sessionID, seq: seq, flag: flagData, payload: payload})
+}
+
+func (c *Conn) sendAck(addr *net.UDPAddr, sessionID uint64, seq uint32) error {
+	return c.write(addr, packet{sessionID: sessionID, seq: seq, flag: flagAck})
+}
+
+func (c *Conn) write(addr *net.UDPAddr, pkt packet) error {
+	_, err := c.udp.WriteToUDP(encodePacket(pkt), addr)
+	return err
+}
+
+// packet is the on-the-wire framing: a fixed header followed by the payload.
+type packet struct {
+	sessionID uint64
+	seq       uint32
+	flag      byte
+	payload   []byte
+}
+
+func encodePacket(pkt packet) []byte {
+	buf := make([]byte, headerLen+len(pkt.payload))
+	binary.BigEndian.PutUint64(buf[0:8], pkt.sessionID)
+	binary.BigEndian.PutUint32(buf[8:12], pkt.seq)
+	buf[12] = pkt.flag
+	copy(buf[headerLen:], pkt.payload)
+	return buf
+}
+
+func decodePacket(data []byte) (packet, error) {
+	if len(data) < headerLen {
+		return packet{}, fmt.Errorf("reliableudp: packet too short (%d bytes)", len(data))
+	}
+	return packet{
+		sessionID: binary.BigEndian.Uint64(data[0:8]),
+		seq:       binary.BigEndian.Uint32(data[8:12]),
+		flag:      data[12],
+		payload:   append([]byte(nil), data[headerLen:]...),
+	}, nil
+}
@@ -0,0 +1,165 @@
+package reliableudp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustListenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	return conn
+}
+
+func echoHandler(peer *net.UDPAddr, payload []byte) []byte {
+	return append([]byte("echo:"), payload...)
+}
+
+func TestSendServeRoundTrip(t *testing.T) {
+	server := New(mustListenUDP(t))
+	defer server.Close()
+	go server.Serve(echoHandler)
+
+	client := New(mustListenUDP(t))
+	defer client.Close()
+	go client.Serve(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := client.Send(ctx, server.udp.LocalAddr().(*net.UDPAddr), []byte("hi"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, want := string(reply), "echo:hi"; got != want {
+		t.Fatalf("Send reply = %q, want %q", got, want)
+	}
+}
+
+// TestSendSurvivesLostReply checks that Send recovers when the reply
+// datagram is lost after the request has already been ACKed: a naive
+// implementation that stops retransmitting once acked would hang here
+// until ctx expired. It relays traffic through a plain UDP socket that
+// deliberately drops the first reply packet it forwards, and asserts
+// Send still returns the reply instead of ctx.Err().
+func TestSendSurvivesLostReply(t *testing.T) {
+	serverUDP := mustListenUDP(t)
+	server := New(serverUDP)
+	defer server.Close()
+	go server.Serve(echoHandler)
+	serverAddr := serverUDP.LocalAddr().(*net.UDPAddr)
+
+	relayUDP := mustListenUDP(t)
+	relayAddr := relayUDP.LocalAddr().(*net.UDPAddr)
+	done := make(chan struct{})
+	defer close(done)
+
+	var (
+		mu           sync.Mutex
+		clientAddr   *net.UDPAddr
+		droppedReply bool
+	)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			relayUDP.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, from, err := relayUDP.ReadFromUDP(buf)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return
+			}
+			data := append([]byte(nil), buf[:n]...)
+
+			if from.String() == serverAddr.String() {
+				pkt, perr := decodePacket(data)
+				mu.Lock()
+				drop := perr == nil && pkt.flag == flagData && !droppedReply
+				if drop {
+					droppedReply = true
+				}
+				to := clientAddr
+				mu.Unlock()
+				if drop || to == nil {
+					continue
+				}
+				relayUDP.WriteToUDP(data, to)
+				continue
+			}
+
+			mu.Lock()
+			clientAddr = from
+			mu.Unlock()
+			relayUDP.WriteToUDP(data, serverAddr)
+		}
+	}()
+
+	client := New(mustListenUDP(t))
+	defer client.Close()
+	go client.Serve(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	reply, err := client.Send(ctx, relayAddr, []byte("hi"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, want := string(reply), "echo:hi"; got != want {
+		t.Fatalf("Send reply = %q, want %q", got, want)
+	}
+}
+
+// TestSendIgnoresForgedReplyFromOtherPeer checks that a reply for a
+// pending session ID is only honored if it comes from the address Send
+// actually sent to. The wrapped socket is unconnected (net.ListenUDP),
+// so without that check a guessed session ID from any reachable host
+// would be accepted as the real server's answer. It encodes a reply
+// packet for the session itself and sends it from an unrelated socket
+// before the genuine server answers, then asserts Send still returns
+// the genuine reply rather than the forged one.
+func TestSendIgnoresForgedReplyFromOtherPeer(t *testing.T) {
+	server := New(mustListenUDP(t))
+	defer server.Close()
+	serverReady := make(chan struct{})
+	go server.Serve(func(peer *net.UDPAddr, payload []byte) []byte {
+		close(serverReady)
+		time.Sleep(50 * time.Millisecond)
+		return append([]byte("echo:"), payload...)
+	})
+	serverAddr := server.udp.LocalAddr().(*net.UDPAddr)
+
+	client := New(mustListenUDP(t))
+	defer client.Close()
+	clientAddr := client.udp.LocalAddr().(*net.UDPAddr)
+	go client.Serve(nil)
+
+	attacker := mustListenUDP(t)
+	defer attacker.Close()
+
+	go func() {
+		<-serverReady
+		forged := encodePacket(packet{sessionID: 1, seq: 0, flag: flagData, payload: []byte("forged")})
+		attacker.WriteToUDP(forged, clientAddr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	reply, err := client.Send(ctx, serverAddr, []byte("hi"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got, want := string(reply), "echo:hi"; got != want {
+		t.Fatalf("Send reply = %q, want %q (forged reply was accepted)", got, want)
+	}
+}
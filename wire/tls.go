@@ -0,0 +1,37 @@
+package wire
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadMutualTLSConfig builds a *tls.Config for mutual TLS from this
+// peer's certificate/key pair and a CA bundle used to verify the peer on
+// the other end. The same CA is shared by both aserver and fserver, so
+// the returned config works for both tls.Listen (verifying the dialer's
+// client certificate) and tls.Dial (verifying the listener's server
+// certificate) against it.
+func LoadMutualTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("wire: loading certificate/key: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("wire: reading CA bundle: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("wire: no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caPool,
+		ClientCAs:    caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
@@ -0,0 +1,48 @@
+// Package wire implements the length-prefixed framing used to carry the
+// JSON messages exchanged between client, aserver and fserver over a
+// stream-oriented connection (plain or TLS-wrapped TCP). UDP transports
+// continue to use the reliableudp package, which frames requests and
+// replies itself.
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// MaxMessageSize bounds the length prefix accepted by Recv, so a
+// corrupt or hostile peer can't make it allocate an unbounded buffer.
+const MaxMessageSize = 1 << 20 // 1 MiB
+
+// Send writes msg to conn as a 4-byte big-endian length prefix followed
+// by msg itself.
+func Send(conn net.Conn, msg []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(msg)))
+	if _, err := conn.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// Recv reads one length-prefixed message from conn.
+func Recv(conn net.Conn) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:])
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("wire: message size %d exceeds maximum %d", n, MaxMessageSize)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}